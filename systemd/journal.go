@@ -0,0 +1,54 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2015 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package systemd
+
+import (
+	"golang.org/x/net/context"
+	"log/syslog"
+)
+
+// LogReader reads unit log entries from the systemd journal. It supports
+// filtering by priority, resuming from a cursor, and following new entries
+// as they are appended.
+type LogReader interface {
+	// SinceCursor seeks the reader to just after the entry with the
+	// given cursor, so that subsequent reads resume from there.
+	SinceCursor(cursor string) error
+	// Tail seeks the reader to the last n entries currently in the
+	// journal.
+	Tail(n int) error
+	// MinPriority restricts subsequent reads to entries at or more
+	// severe than prio.
+	MinPriority(prio syslog.Priority) error
+	// Next returns the next matching entry, or io.EOF once the current
+	// contents of the journal have been exhausted.
+	Next() (Log, error)
+	// Follow streams matching entries from the current read position
+	// onward on the returned channel, including new ones as they are
+	// appended to the journal, until ctx is cancelled.
+	Follow(ctx context.Context) (<-chan Log, error)
+	// Close releases the underlying journal handle.
+	Close() error
+}
+
+// newJournalReader opens a LogReader matching the given unit names. It is a
+// variable so the tests can substitute a fake backend, avoiding the need to
+// link against libsystemd.
+var newJournalReader = newSdJournalReader
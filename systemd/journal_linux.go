@@ -0,0 +1,193 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+// +build linux
+
+/*
+ * Copyright (C) 2015 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package systemd
+
+import (
+	"io"
+	"log/syslog"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/go-systemd/sdjournal"
+)
+
+// sdJournalReader is the libsystemd-backed LogReader, used on real systemd
+// systems.
+type sdJournalReader struct {
+	j       *sdjournal.Journal
+	minPrio syslog.Priority
+	prioSet bool
+}
+
+// journalMatcher is the subset of *sdjournal.Journal used to build up the
+// unit match filter; factored out so addUnitMatches can be tested without
+// a live journal.
+type journalMatcher interface {
+	AddMatch(match string) error
+	AddDisjunction() error
+}
+
+func newSdJournalReader(units []string) (LogReader, error) {
+	j, err := sdjournal.NewJournal()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := addUnitMatches(j, units); err != nil {
+		j.Close()
+		return nil, err
+	}
+
+	return &sdJournalReader{j: j}, nil
+}
+
+// addUnitMatches adds a match term for each unit, ORing them together with
+// AddDisjunction so that entries from any of the units are matched. The
+// disjunction only goes *between* units, leaving the match stack closed
+// after the last one, so a later AddMatch (e.g. MinPriority) is ANDed with
+// the whole unit filter instead of being pulled into a trailing open
+// OR-group.
+func addUnitMatches(j journalMatcher, units []string) error {
+	for i, unit := range units {
+		if i > 0 {
+			if err := j.AddDisjunction(); err != nil {
+				return err
+			}
+		}
+		if err := j.AddMatch("_SYSTEMD_UNIT=" + unit); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *sdJournalReader) SinceCursor(cursor string) error {
+	if err := r.j.SeekCursor(cursor); err != nil {
+		return err
+	}
+	// SeekCursor leaves the entry with the cursor as the one Next reads
+	// first; step over it so reading resumes just after it.
+	_, err := r.j.Next()
+	return err
+}
+
+func (r *sdJournalReader) Tail(n int) error {
+	if err := r.j.SeekTail(); err != nil {
+		return err
+	}
+	// Next advances before reading, so step back one further than n; if
+	// the journal holds fewer entries than that, start from its head.
+	skipped, err := r.j.PreviousSkip(uint64(n) + 1)
+	if err != nil {
+		return err
+	}
+	if skipped < uint64(n)+1 {
+		return r.j.SeekHead()
+	}
+	return nil
+}
+
+// MinPriority restricts Next to entries at or above prio. sd_journal's
+// AddMatch only understands literal FIELD=value equality, not relational
+// operators like "PRIORITY<=3", so this can't be expressed as a journal
+// match term; instead we remember the bound and filter client-side in
+// Next, the same way the test-only fakeLogReader does.
+func (r *sdJournalReader) MinPriority(prio syslog.Priority) error {
+	r.minPrio = prio
+	r.prioSet = true
+	return nil
+}
+
+func (r *sdJournalReader) Next() (Log, error) {
+	for {
+		n, err := r.j.Next()
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, io.EOF
+		}
+
+		entry, err := r.j.GetEntry()
+		if err != nil {
+			return nil, err
+		}
+
+		if r.prioSet {
+			prio, _ := strconv.Atoi(entry.Fields["PRIORITY"])
+			if syslog.Priority(prio) > r.minPrio {
+				continue
+			}
+		}
+
+		log := make(Log, len(entry.Fields)+1)
+		for k, v := range entry.Fields {
+			log[k] = v
+		}
+		log["__REALTIME_TIMESTAMP"] = strconv.FormatUint(entry.RealtimeTimestamp, 10)
+		log["__CURSOR"] = entry.Cursor
+
+		return log, nil
+	}
+}
+
+func (r *sdJournalReader) Follow(ctx context.Context) (<-chan Log, error) {
+	ch := make(chan Log)
+
+	go func() {
+		defer close(ch)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			r.j.Wait(time.Second)
+
+			for {
+				log, err := r.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return
+				}
+
+				select {
+				case ch <- log:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (r *sdJournalReader) Close() error {
+	return r.j.Close()
+}
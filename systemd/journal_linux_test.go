@@ -0,0 +1,74 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+// +build linux
+
+/*
+ * Copyright (C) 2015 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package systemd
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type JournalMatcherTestSuite struct{}
+
+var _ = Suite(&JournalMatcherTestSuite{})
+
+// fakeJournalMatcher records the sequence of AddMatch/AddDisjunction calls
+// made against it, so tests can assert on the shape of the match stack
+// without a live journal.
+type fakeJournalMatcher struct {
+	ops []string
+}
+
+func (m *fakeJournalMatcher) AddMatch(match string) error {
+	m.ops = append(m.ops, "match:"+match)
+	return nil
+}
+
+func (m *fakeJournalMatcher) AddDisjunction() error {
+	m.ops = append(m.ops, "or")
+	return nil
+}
+
+func (s *JournalMatcherTestSuite) TestAddUnitMatchesSingleUnit(c *C) {
+	m := &fakeJournalMatcher{}
+	c.Assert(addUnitMatches(m, []string{"foo"}), IsNil)
+
+	// no trailing disjunction: a later AddMatch (e.g. for MinPriority)
+	// must be ANDed with this, not OR'd into an open group.
+	c.Check(m.ops, DeepEquals, []string{"match:_SYSTEMD_UNIT=foo"})
+}
+
+func (s *JournalMatcherTestSuite) TestAddUnitMatchesMultipleUnits(c *C) {
+	m := &fakeJournalMatcher{}
+	c.Assert(addUnitMatches(m, []string{"foo", "bar", "baz"}), IsNil)
+
+	c.Check(m.ops, DeepEquals, []string{
+		"match:_SYSTEMD_UNIT=foo",
+		"or",
+		"match:_SYSTEMD_UNIT=bar",
+		"or",
+		"match:_SYSTEMD_UNIT=baz",
+	})
+}
+
+func (s *JournalMatcherTestSuite) TestAddUnitMatchesNoUnits(c *C) {
+	m := &fakeJournalMatcher{}
+	c.Assert(addUnitMatches(m, nil), IsNil)
+	c.Check(m.ops, IsNil)
+}
@@ -0,0 +1,182 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2015 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package systemd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// journalSocketPath is where systemd-journald listens for structured log
+// entries using its native export protocol.
+const journalSocketPath = "/run/systemd/journal/socket"
+
+// Well-known MESSAGE_ID values for events snapd cares about, so that
+// "journalctl MESSAGE_ID=..." can find them regardless of the human
+// readable MESSAGE.
+const (
+	MessageIDInstall = "531923ec04f14e23b7e0b9fb2a52b0b4"
+	MessageIDRefresh = "9cc2fb1483f04b1c9d7a6d99c3c6b0fa"
+	MessageIDRemove  = "f0d7ef637ba241c98b27a4d3cd9b7ffe"
+)
+
+// journalDial opens a connection to the journal's native socket, and is
+// overridden in the tests.
+var journalDial = func() (net.Conn, error) {
+	return net.Dial("unixgram", journalSocketPath)
+}
+
+// Journal sends structured log records to systemd-journald using its
+// native export (datagram) protocol, so snapd and hooks can attach
+// structured fields (SNAP_NAME, SNAP_REVISION, MESSAGE_ID, ...) to their
+// log messages instead of a single opaque line.
+//
+// Journal implements io.Writer so it can be plugged in as a logger
+// backend; a plain Write becomes the MESSAGE field of an entry tagged with
+// Identifier.
+type Journal struct {
+	// Identifier is sent as SYSLOG_IDENTIFIER on every entry, unless the
+	// caller already set one explicitly via Send.
+	Identifier string
+}
+
+// NewJournal returns a Journal that tags its entries with the given
+// SYSLOG_IDENTIFIER.
+func NewJournal(identifier string) *Journal {
+	return &Journal{Identifier: identifier}
+}
+
+// Write implements io.Writer, sending p as the MESSAGE field of an entry.
+func (j *Journal) Write(p []byte) (int, error) {
+	if err := j.Send(map[string]interface{}{"MESSAGE": string(p)}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Send sends fields as a single structured journal entry. If the journal
+// socket is unavailable (e.g. in tests, or on a non-systemd host) it falls
+// back to writing "KEY=value" pairs to stderr, so callers keep working.
+func (j *Journal) Send(fields map[string]interface{}) error {
+	out := make(map[string]interface{}, len(fields)+1)
+	for k, v := range fields {
+		out[k] = v
+	}
+	if j.Identifier != "" {
+		if _, ok := out["SYSLOG_IDENTIFIER"]; !ok {
+			out["SYSLOG_IDENTIFIER"] = j.Identifier
+		}
+	}
+	fields = out
+
+	data, err := encodeJournalExport(fields)
+	if err != nil {
+		return err
+	}
+
+	conn, err := journalDial()
+	if err != nil {
+		return sendToStderr(fields)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(data); err != nil {
+		return sendToStderr(fields)
+	}
+
+	return nil
+}
+
+// journalFallback is where entries go when the journal socket can't be
+// reached; it's a variable so the tests can capture it.
+var journalFallback io.Writer = os.Stderr
+
+// sendToStderr is the fallback used when the journal socket can't be
+// reached.
+func sendToStderr(fields map[string]interface{}) error {
+	_, err := journalFallback.Write(encodeLogfmt(fields))
+	return err
+}
+
+func encodeLogfmt(fields map[string]interface{}) []byte {
+	var buf bytes.Buffer
+	for _, k := range sortedKeys(fields) {
+		fmt.Fprintf(&buf, "%s=%v\n", k, fields[k])
+	}
+	return buf.Bytes()
+}
+
+// encodeJournalExport encodes fields using the journal's native export
+// wire format: "KEY=value\n" for values with no embedded newline, or
+// "KEY\n<8-byte LE length>\n<value bytes>\n" when the value has one.
+func encodeJournalExport(fields map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, k := range sortedKeys(fields) {
+		if err := validateFieldName(k); err != nil {
+			return nil, err
+		}
+
+		v := fmt.Sprint(fields[k])
+		if !strings.Contains(v, "\n") {
+			fmt.Fprintf(&buf, "%s=%s\n", k, v)
+			continue
+		}
+
+		buf.WriteString(k)
+		buf.WriteByte('\n')
+		if err := binary.Write(&buf, binary.LittleEndian, uint64(len(v))); err != nil {
+			return nil, err
+		}
+		buf.WriteString(v)
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes(), nil
+}
+
+func sortedKeys(fields map[string]interface{}) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validateFieldName checks that name is a valid journal field name: only
+// uppercase letters, digits and underscores, and must not start with an
+// underscore (those are reserved for fields set by journald itself).
+func validateFieldName(name string) error {
+	if name == "" || name[0] == '_' {
+		return fmt.Errorf("invalid journal field name: %q", name)
+	}
+	for _, r := range name {
+		if r != '_' && !(r >= 'A' && r <= 'Z') && !(r >= '0' && r <= '9') {
+			return fmt.Errorf("invalid journal field name: %q", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2015 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package systemd
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type JournalTestSuite struct {
+	sock *net.UnixConn
+	buf  bytes.Buffer
+}
+
+var _ = Suite(&JournalTestSuite{})
+
+func (s *JournalTestSuite) SetUpTest(c *C) {
+	addr := &net.UnixAddr{Name: filepath.Join(c.MkDir(), "journal.socket"), Net: "unixgram"}
+	sock, err := net.ListenUnixgram("unixgram", addr)
+	c.Assert(err, IsNil)
+	s.sock = sock
+
+	journalDial = func() (net.Conn, error) {
+		return net.DialUnix("unixgram", nil, addr)
+	}
+
+	s.buf.Reset()
+	journalFallback = &s.buf
+}
+
+func (s *JournalTestSuite) TearDownTest(c *C) {
+	s.sock.Close()
+	journalDial = func() (net.Conn, error) {
+		return net.Dial("unixgram", journalSocketPath)
+	}
+	journalFallback = nil
+}
+
+func (s *JournalTestSuite) recv(c *C) []byte {
+	buf := make([]byte, 4096)
+	n, err := s.sock.Read(buf)
+	c.Assert(err, IsNil)
+	return buf[:n]
+}
+
+func (s *JournalTestSuite) TestSendSimpleFields(c *C) {
+	j := NewJournal("snapd")
+	c.Assert(j.Send(map[string]interface{}{"SNAP_NAME": "hello", "MESSAGE": "installed"}), IsNil)
+
+	got := string(s.recv(c))
+	c.Check(got, Matches, `(?s).*SNAP_NAME=hello\n.*`)
+	c.Check(got, Matches, `(?s).*MESSAGE=installed\n.*`)
+	c.Check(got, Matches, `(?s).*SYSLOG_IDENTIFIER=snapd\n.*`)
+}
+
+func (s *JournalTestSuite) TestSendMultilineValueIsLengthPrefixed(c *C) {
+	j := NewJournal("")
+	c.Assert(j.Send(map[string]interface{}{"MESSAGE": "line one\nline two"}), IsNil)
+
+	got := s.recv(c)
+	c.Check(bytes.HasPrefix(got, []byte("MESSAGE\n")), Equals, true)
+	c.Check(bytes.Contains(got, []byte("line one\nline two\n")), Equals, true)
+}
+
+func (s *JournalTestSuite) TestWriteSendsMessage(c *C) {
+	j := NewJournal("snapd")
+	n, err := j.Write([]byte("hello there"))
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, len("hello there"))
+
+	c.Check(string(s.recv(c)), Matches, `(?s).*MESSAGE=hello there\n.*`)
+}
+
+func (s *JournalTestSuite) TestSendFallsBackWhenSocketIsAbsent(c *C) {
+	journalDial = func() (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Err: net.UnknownNetworkError("nope")}
+	}
+
+	j := NewJournal("snapd")
+	c.Assert(j.Send(map[string]interface{}{"MESSAGE": "hi"}), IsNil)
+
+	c.Check(s.buf.String(), Matches, `(?s).*MESSAGE=hi\n.*`)
+}
+
+func (s *JournalTestSuite) TestSendRejectsBadFieldName(c *C) {
+	j := NewJournal("")
+	err := j.Send(map[string]interface{}{"lower case": "nope"})
+	c.Assert(err, NotNil)
+}
+
+func (s *JournalTestSuite) TestSendDoesNotMutateCallersFields(c *C) {
+	fields := map[string]interface{}{"MESSAGE": "hi"}
+
+	c.Assert(NewJournal("first").Send(fields), IsNil)
+	s.recv(c)
+
+	c.Assert(NewJournal("second").Send(fields), IsNil)
+	got := string(s.recv(c))
+
+	c.Check(got, Matches, `(?s).*SYSLOG_IDENTIFIER=second\n.*`)
+	c.Check(fields, DeepEquals, map[string]interface{}{"MESSAGE": "hi"})
+}
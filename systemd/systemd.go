@@ -0,0 +1,850 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2014-2015 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package systemd knows how to talk to systemd and can be used to
+// generate service files, as well as start/stop/enable/disable
+// services and check their status.
+package systemd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ubuntu-core/snappy/arch"
+	"github.com/ubuntu-core/snappy/dirs"
+)
+
+var (
+	// the default target for systemd units that we generate
+	servicesTarget = "multi-user.target"
+	// the default target for socket units that we generate
+	socketsTarget = "sockets.target"
+
+	stopSteps = 4 * 30
+	stopDelay = 250 * time.Millisecond
+)
+
+// Reporter is the interface used to report progress back to the user
+// while we wait for service operations to complete.
+type Reporter interface {
+	Notify(msg string)
+}
+
+// Systemd exposes a minimal interface to manage systemd via the systemctl
+// command.
+type Systemd interface {
+	DaemonReload() error
+	Enable(serviceName string) error
+	Disable(serviceName string) error
+	Start(serviceName string) error
+	Stop(serviceName string, timeout time.Duration) error
+	Kill(serviceName, signal string) error
+	Restart(serviceName string, timeout time.Duration) error
+	GenServiceFile(desc *ServiceDescription) string
+	GenSocketFile(desc *ServiceDescription) string
+	GenTimerFile(desc *ServiceDescription) (string, error)
+	GenDeviceDropIn(desc *ServiceDescription) string
+	WriteDeviceDropIn(desc *ServiceDescription) (string, error)
+	Status(serviceName string) (string, error)
+	ServiceStatus(serviceName string) (*ServiceStatus, error)
+	Logs(serviceNames []string) ([]Log, error)
+	OpenLog(serviceNames []string) (LogReader, error)
+	WriteMountUnitFile(name, what, where string) (string, error)
+}
+
+// New returns a Systemd that uses the given rootDir (if non-empty, it is
+// passed to systemctl via --root) to talk to systemd, and reports progress
+// via the given Reporter.
+func New(rootDir string, rep Reporter) Systemd {
+	return &systemd{rootDir: rootDir, rep: rep}
+}
+
+type systemd struct {
+	rootDir string
+	rep     Reporter
+}
+
+// run calls SystemctlCmd, adding --root if rootDir is set.
+func (s *systemd) run(args ...string) ([]byte, error) {
+	if s.rootDir != "" {
+		args = append([]string{"--root", s.rootDir}, args...)
+	}
+	return SystemctlCmd(args...)
+}
+
+// SystemctlCmd is called from the various Systemd.* methods, and is
+// overridden in the tests.
+var SystemctlCmd = run
+
+func run(args ...string) ([]byte, error) {
+	bs, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		exitCode := 0
+		if e, ok := err.(*exec.ExitError); ok {
+			exitCode = e.Sys().(interface{ ExitStatus() int }).ExitStatus()
+		}
+		return nil, &Error{cmd: args, exitCode: exitCode, msg: bs}
+	}
+
+	return bs, nil
+}
+
+// Error is returned if the systemctl command failed
+type Error struct {
+	cmd      []string
+	exitCode int
+	msg      []byte
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v failed with exit status %d: %s", e.cmd, e.exitCode, e.msg)
+}
+
+// Timeout is returned if a service fails to stop in the allotted time.
+type Timeout struct {
+	action  string
+	service string
+}
+
+func (e *Timeout) Error() string {
+	return fmt.Sprintf("%v failed to %v: timeout", e.service, e.action)
+}
+
+// IsTimeout checks whether the given error is a Timeout
+func IsTimeout(err error) bool {
+	_, ok := err.(*Timeout)
+	return ok
+}
+
+func (s *systemd) DaemonReload() error {
+	_, err := s.run("daemon-reload")
+	return err
+}
+
+func (s *systemd) Enable(serviceName string) error {
+	_, err := s.run("enable", s.enableUnitFor(serviceName))
+	return err
+}
+
+func (s *systemd) Disable(serviceName string) error {
+	_, err := s.run("disable", s.enableUnitFor(serviceName))
+	return err
+}
+
+// enableUnitFor returns the unit that Enable/Disable act on: a companion
+// .socket unit takes precedence (so the service is only started on
+// connection), followed by a companion .timer unit (so it's started on
+// schedule instead), and finally the service itself.
+func (s *systemd) enableUnitFor(serviceName string) string {
+	if hasSocketUnit(serviceName) {
+		return socketUnitName(serviceName)
+	}
+	if hasTimerUnit(serviceName) {
+		return timerUnitName(serviceName)
+	}
+	return serviceName
+}
+
+func (s *systemd) Start(serviceName string) error {
+	_, err := s.run("start", s.unitToManage(serviceName))
+	return err
+}
+
+// unitToManage returns the unit that Start/Stop should actually act on:
+// the service's companion .socket unit, if one was generated for it, or
+// the service itself otherwise. This lets systemd hold the service down
+// until something connects to the socket. Enable/Disable route through
+// enableUnitFor instead.
+func (s *systemd) unitToManage(serviceName string) string {
+	if hasSocketUnit(serviceName) {
+		return socketUnitName(serviceName)
+	}
+	return serviceName
+}
+
+func (s *systemd) Kill(serviceName, signal string) error {
+	_, err := s.run("kill", serviceName, "-s", signal)
+	return err
+}
+
+func (s *systemd) Restart(serviceName string, timeout time.Duration) error {
+	if err := s.Stop(serviceName, timeout); err != nil {
+		return err
+	}
+	return s.Start(serviceName)
+}
+
+func (s *systemd) Stop(serviceName string, timeout time.Duration) error {
+	unit := s.unitToManage(serviceName)
+	if _, err := s.run("stop", unit); err != nil {
+		return err
+	}
+
+	// and now wait for it to actually stop
+	for i := 0; i < stopSteps; i++ {
+		if i == 0 && s.rep != nil {
+			s.rep.Notify(fmt.Sprintf("Waiting for %s to stop.", serviceName))
+		}
+
+		bs, err := s.run("show", "--property=ActiveState", unit)
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(bs)) == "ActiveState=inactive" {
+			return nil
+		}
+
+		time.Sleep(stopDelay)
+	}
+
+	return &Timeout{action: "stop", service: serviceName}
+}
+
+// ServiceStatus holds structured information about a given service loaded
+// into systemd.
+type ServiceStatus struct {
+	ServiceFileName string
+	LoadState       string
+	ActiveState     string
+	SubState        string
+	UnitFileState   string
+}
+
+func (s *systemd) serviceProperties(serviceName string) (map[string]string, error) {
+	bs, err := s.run("show", "--property=Id,LoadState,ActiveState,SubState,UnitFileState", serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	props := make(map[string]string)
+	for _, line := range strings.Split(string(bs), "\n") {
+		if line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		props[kv[0]] = kv[1]
+	}
+
+	return props, nil
+}
+
+func (s *systemd) ServiceStatus(serviceName string) (*ServiceStatus, error) {
+	props, err := s.serviceProperties(serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ServiceStatus{
+		ServiceFileName: serviceName,
+		LoadState:       props["LoadState"],
+		ActiveState:     props["ActiveState"],
+		SubState:        props["SubState"],
+		UnitFileState:   props["UnitFileState"],
+	}, nil
+}
+
+func (s *systemd) Status(serviceName string) (string, error) {
+	status, err := s.ServiceStatus(serviceName)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s; %s; %s (%s)", status.UnitFileState, status.LoadState, status.ActiveState, status.SubState), nil
+}
+
+// Log is a single entry in the systemd journal.
+type Log map[string]interface{}
+
+// String formats a Log entry as "<timestamp> <identifier> <message>", with
+// the PRIORITY field, when set, inserted after the timestamp in angle
+// brackets (e.g. "<3>").
+func (l Log) String() string {
+	t, ok := l["__REALTIME_TIMESTAMP"]
+	if !ok {
+		return "-(no timestamp!)- - -"
+	}
+
+	sstr, ok := t.(string)
+	if !ok {
+		return fmt.Sprintf("-(timestamp not a string: %#v)- - -", t)
+	}
+
+	us, err := strconv.ParseInt(sstr, 10, 64)
+	if err != nil {
+		return fmt.Sprintf("-(timestamp not a decimal number: %#v)- - -", sstr)
+	}
+
+	stamp := time.Unix(us/1000000, (us%1000000)*1000).UTC().Format("2006-01-02T15:04:05.000000") + "Z"
+
+	identifier, _ := l["SYSLOG_IDENTIFIER"].(string)
+	if identifier == "" {
+		identifier = "-"
+	}
+	message, _ := l["MESSAGE"].(string)
+	if message == "" {
+		message = "-"
+	}
+
+	parts := []string{stamp}
+	if prio, ok := l["PRIORITY"].(string); ok && prio != "" {
+		parts = append(parts, "<"+prio+">")
+	}
+	parts = append(parts, identifier, message)
+
+	return strings.Join(parts, " ")
+}
+
+// OpenLog opens a LogReader matching the given units.
+func (s *systemd) OpenLog(serviceNames []string) (LogReader, error) {
+	return newJournalReader(serviceNames)
+}
+
+// Logs returns the unit logs for the given services, most recent ones last.
+// It is a thin wrapper around OpenLog kept for callers that just want a
+// one-shot snapshot rather than a LogReader.
+func (s *systemd) Logs(serviceNames []string) ([]Log, error) {
+	r, err := s.OpenLog(serviceNames)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var logs []Log
+	for {
+		log, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, log)
+	}
+
+	return logs, nil
+}
+
+// RestartCondition encapsulates the restart conditions that systemd can
+// use to decide whether to restart a service.
+type RestartCondition string
+
+// These are the restart conditions systemd understands.
+const (
+	RestartNever      RestartCondition = "no"
+	RestartOnSuccess  RestartCondition = "on-success"
+	RestartOnFailure  RestartCondition = "on-failure"
+	RestartOnAbnormal RestartCondition = "on-abnormal"
+	RestartOnAbort    RestartCondition = "on-abort"
+	RestartOnWatchdog RestartCondition = "on-watchdog"
+	RestartAlways     RestartCondition = "always"
+)
+
+var restartMap = map[string]RestartCondition{
+	"no":          RestartNever,
+	"on-success":  RestartOnSuccess,
+	"on-failure":  RestartOnFailure,
+	"on-abnormal": RestartOnAbnormal,
+	"on-abort":    RestartOnAbort,
+	"on-watchdog": RestartOnWatchdog,
+	"always":      RestartAlways,
+}
+
+// String returns the systemd-understood string for the restart condition.
+func (rc RestartCondition) String() string {
+	return string(rc)
+}
+
+// UnmarshalYAML so RestartCondition can be used directly in snap.yaml.
+func (rc *RestartCondition) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+
+	cond, ok := restartMap[str]
+	if !ok {
+		return fmt.Errorf("invalid restart condition: %q", str)
+	}
+	*rc = cond
+
+	return nil
+}
+
+// ServiceDescription describes a snap service that we want to create a
+// systemd .service unit for.
+type ServiceDescription struct {
+	SnapName    string
+	AppName     string
+	Version     string
+	Revision    int
+	Description string
+	SnapPath    string
+	Start       string
+	Stop        string
+	PostStop    string
+	StopTimeout time.Duration
+	AaProfile   string
+	BusName     string
+	UdevAppName string
+	Type        string
+	Restart     RestartCondition
+
+	// socket activation
+	ListenStream   string
+	ListenDatagram string
+	SocketMode     string
+	SocketUser     string
+	SocketGroup    string
+	Accept         bool
+
+	// timer activation
+	Timer *TimerSchedule
+
+	// device binding
+	BoundDevices []DeviceMatch
+}
+
+// DeviceMatch identifies a udev-assigned hardware device that a service
+// should only be started while present.
+type DeviceMatch struct {
+	// Subsystem is the udev subsystem the device belongs to (e.g. "tty",
+	// "usb"), used together with KernelName to scope the generated udev
+	// rule to the right device.
+	Subsystem string
+	// KernelName is the device's kernel name (e.g. "ttyUSB0"), or a glob
+	// pattern matching it.
+	KernelName string
+	// Tag, if set, names a stable alias for the device (independent of
+	// its kernel name) that the generated udev rule registers via the
+	// SYSTEMD_ALIAS property; DeviceUnitName uses it in preference to
+	// KernelName when present.
+	Tag string
+}
+
+// HasBoundDevices returns true if desc should only run while some
+// assigned hardware is present.
+func (desc *ServiceDescription) HasBoundDevices() bool {
+	return len(desc.BoundDevices) > 0
+}
+
+// DeviceUnitName returns the .device unit name systemd generates for this
+// device: the escaped /dev alias registered by GenDeviceUdevRule's
+// SYSTEMD_ALIAS, if Tag is set, or the escaped /dev/<KernelName> node
+// otherwise.
+func (d *DeviceMatch) DeviceUnitName() string {
+	name := d.KernelName
+	if d.Tag != "" {
+		name = d.Tag
+	}
+	return SystemdEscape(filepath.Join("/dev", name)) + ".device"
+}
+
+// GenDeviceUdevRule generates the udev rule line that tags the device
+// matched by d for systemd, so that udev creates a .device unit for it in
+// the first place, and (when d.Tag is set) registers the /dev/<Tag> alias
+// that DeviceUnitName then derives its unit name from.
+func GenDeviceUdevRule(d *DeviceMatch) string {
+	rule := fmt.Sprintf(`SUBSYSTEM=="%s", KERNEL=="%s", TAG+="systemd"`, d.Subsystem, d.KernelName)
+	if d.Tag != "" {
+		rule += fmt.Sprintf(`, ENV{SYSTEMD_ALIAS}="/dev/%s"`, d.Tag)
+	}
+	return rule + "\n"
+}
+
+// HasSocket returns true if desc carries enough information to generate a
+// companion .socket unit.
+func (desc *ServiceDescription) HasSocket() bool {
+	return desc.ListenStream != "" || desc.ListenDatagram != ""
+}
+
+// HasTimer returns true if desc carries a schedule to generate a
+// companion .timer unit.
+func (desc *ServiceDescription) HasTimer() bool {
+	return desc.Timer != nil
+}
+
+// TimerSchedule describes the [Timer] section of a .timer unit that
+// activates a snap service on a schedule instead of on boot.
+type TimerSchedule struct {
+	OnCalendar         string
+	OnBootSec          string
+	OnUnitActiveSec    string
+	Persistent         bool
+	RandomizedDelaySec string
+}
+
+const launcherCmd = "/usr/bin/ubuntu-core-launcher"
+
+const serviceTemplate = `[Unit]
+Description={{.Description}}
+After=snapd.frameworks.target
+Requires=snapd.frameworks.target
+{{if .HasSocket}}Also={{.ServiceFileName}}.socket
+{{end -}}
+{{range .DeviceUnits}}BindsTo={{.}}
+After={{.}}
+{{end -}}
+X-Snappy=yes
+
+[Service]
+ExecStart={{.LauncherCmd}} {{.SnapPath}}/{{.Start}}
+Restart={{.Restart}}
+WorkingDirectory={{.SnapDataDir}}
+Environment={{.Environment}}
+{{if .Stop}}ExecStop={{.LauncherCmd}} {{.SnapPath}}/{{.Stop}}
+{{end -}}
+{{if .PostStop}}ExecStopPost={{.LauncherCmd}} {{.SnapPath}}/{{.PostStop}}
+{{end -}}
+{{if .StopTimeout}}TimeoutStopSec={{.StopTimeout.Seconds}}
+{{end -}}
+{{if .Type}}Type={{.Type}}
+{{end -}}
+{{if .BusName}}BusName={{.BusName}}{{end}}
+
+[Install]
+WantedBy={{.ServicesTarget}}
+`
+
+// GenServiceFile generates the systemd .service unit for the given
+// ServiceDescription.
+func (s *systemd) GenServiceFile(desc *ServiceDescription) string {
+	serviceFileName := filepath.Base(generateServiceFileName(desc))
+
+	snapDataDir := filepath.Join(dirs.SnapDataDir, desc.SnapName, desc.Version)
+	snapSharedDataDir := filepath.Join(dirs.SnapDataDir, desc.SnapName, "shared")
+	snapUserDataDir := filepath.Join("%h", "apps", desc.SnapName, desc.Version)
+	snapUserSharedDataDir := filepath.Join("%h", "apps", desc.SnapName, "shared")
+
+	env := fmt.Sprintf(`"SNAP=%s" "SNAP_DATA=%s" "SNAP_SHARED_DATA=%s" "SNAP_NAME=%s" "SNAP_VERSION=%s" "SNAP_REVISION=%d" "SNAP_ARCH=%s" "SNAP_LIBRARY_PATH=%s" "SNAP_USER_DATA=%s" "SNAP_USER_SHARED_DATA=%s"`,
+		desc.SnapPath, snapDataDir, snapSharedDataDir, desc.SnapName, desc.Version, desc.Revision,
+		arch.UbuntuArchitecture(), dirs.SnapLibGLDir, snapUserDataDir, snapUserSharedDataDir)
+
+	deviceUnits := make([]string, len(desc.BoundDevices))
+	for i, dev := range desc.BoundDevices {
+		deviceUnits[i] = dev.DeviceUnitName()
+	}
+
+	// the companion .socket unit is never a template, even when this
+	// service is (see generateServiceFileName), so strip both suffixes
+	// to get its base name
+	socketBaseName := strings.TrimSuffix(strings.TrimSuffix(serviceFileName, ".service"), "@")
+
+	restart := desc.Restart
+	if restart == "" {
+		restart = RestartOnFailure
+	}
+
+	wrapped := struct {
+		*ServiceDescription
+		Restart         RestartCondition
+		LauncherCmd     string
+		SnapDataDir     string
+		Environment     string
+		ServicesTarget  string
+		ServiceFileName string
+		DeviceUnits     []string
+	}{
+		ServiceDescription: desc,
+		Restart:            restart,
+		LauncherCmd:        fmt.Sprintf("%s %s %s", launcherCmd, desc.UdevAppName, desc.AaProfile),
+		SnapDataDir:        snapDataDir,
+		Environment:        env,
+		ServicesTarget:     servicesTarget,
+		ServiceFileName:    socketBaseName,
+		DeviceUnits:        deviceUnits,
+	}
+
+	var out bytes.Buffer
+	t := template.Must(template.New(serviceFileName).Parse(serviceTemplate))
+	if err := t.Execute(&out, wrapped); err != nil {
+		panic(fmt.Sprintf("can't execute service template: %v", err))
+	}
+
+	return out.String()
+}
+
+// generateServiceFileName returns the .service unit file name for desc. An
+// Accept=yes socket can only activate an instantiated unit (Service= isn't
+// even valid on such sockets), so in that case the name is a template
+// (<base>@.service) that systemd instantiates once per connection.
+func generateServiceFileName(desc *ServiceDescription) string {
+	base := fmt.Sprintf("%s_%s_%s", desc.SnapName, desc.AppName, desc.Version)
+	if desc.Accept {
+		return base + "@.service"
+	}
+	return base + ".service"
+}
+
+const socketTemplate = `[Socket]
+{{if .ListenStream}}ListenStream={{.ListenStream}}
+{{end -}}
+{{if .ListenDatagram}}ListenDatagram={{.ListenDatagram}}
+{{end -}}
+{{if .Accept}}Accept=yes
+{{end -}}
+{{if .SocketMode}}SocketMode={{.SocketMode}}
+{{end -}}
+{{if .SocketUser}}SocketUser={{.SocketUser}}
+{{end -}}
+{{if .SocketGroup}}SocketGroup={{.SocketGroup}}
+{{end}}
+[Install]
+WantedBy={{.SocketsTarget}}
+`
+
+// GenSocketFile generates the systemd .socket unit that activates the
+// service described by desc on-demand. Callers should only call this when
+// desc.HasSocket() is true.
+func (s *systemd) GenSocketFile(desc *ServiceDescription) string {
+	wrapped := struct {
+		*ServiceDescription
+		SocketsTarget string
+	}{desc, socketsTarget}
+
+	var out bytes.Buffer
+	t := template.Must(template.New(generateServiceFileName(desc)).Parse(socketTemplate))
+	if err := t.Execute(&out, wrapped); err != nil {
+		panic(fmt.Sprintf("can't execute socket template: %v", err))
+	}
+
+	return out.String()
+}
+
+// socketUnitName returns the .socket unit name that corresponds to the
+// given .service unit name.
+func socketUnitName(serviceName string) string {
+	return strings.TrimSuffix(serviceName, ".service") + ".socket"
+}
+
+// hasSocketUnit returns true if a .socket unit file was generated
+// alongside the given .service unit.
+func hasSocketUnit(serviceName string) bool {
+	_, err := osStat(filepath.Join(dirs.SnapServicesDir, socketUnitName(serviceName)))
+	return err == nil
+}
+
+// osStat is a variable so it can be overridden in tests.
+var osStat = os.Stat
+
+// SystemdAnalyzeCmd is called to validate OnCalendar schedules, and is
+// overridden in the tests.
+var SystemdAnalyzeCmd = systemdAnalyze
+
+func systemdAnalyze(args ...string) ([]byte, error) {
+	return exec.Command("systemd-analyze", args...).CombinedOutput()
+}
+
+// validateOnCalendar checks that spec is a schedule systemd-analyze
+// understands.
+func validateOnCalendar(spec string) error {
+	out, err := SystemdAnalyzeCmd("calendar", spec)
+	if err != nil {
+		return &Error{cmd: []string{"systemd-analyze", "calendar", spec}, exitCode: 1, msg: out}
+	}
+	return nil
+}
+
+const timerTemplate = `[Unit]
+Description={{.Description}}
+X-Snappy=yes
+
+[Timer]
+{{if .OnCalendar}}OnCalendar={{.OnCalendar}}
+{{end -}}
+{{if .OnBootSec}}OnBootSec={{.OnBootSec}}
+{{end -}}
+{{if .OnUnitActiveSec}}OnUnitActiveSec={{.OnUnitActiveSec}}
+{{end -}}
+{{if .Persistent}}Persistent=yes
+{{end -}}
+{{if .RandomizedDelaySec}}RandomizedDelaySec={{.RandomizedDelaySec}}
+{{end -}}
+Unit={{.ServiceFileName}}.service
+
+[Install]
+WantedBy=timers.target
+`
+
+// GenTimerFile generates the systemd .timer unit that activates the
+// service described by desc on the configured schedule. Callers should
+// only call this when desc.HasTimer() is true.
+func (s *systemd) GenTimerFile(desc *ServiceDescription) (string, error) {
+	if desc.Timer.OnCalendar != "" {
+		if err := validateOnCalendar(desc.Timer.OnCalendar); err != nil {
+			return "", fmt.Errorf("cannot use %q as a timer schedule: %v", desc.Timer.OnCalendar, err)
+		}
+	}
+
+	wrapped := struct {
+		*TimerSchedule
+		Description     string
+		ServiceFileName string
+	}{
+		TimerSchedule:   desc.Timer,
+		Description:     desc.Description,
+		ServiceFileName: strings.TrimSuffix(generateServiceFileName(desc), ".service"),
+	}
+
+	var out bytes.Buffer
+	t := template.Must(template.New(generateServiceFileName(desc)).Parse(timerTemplate))
+	if err := t.Execute(&out, wrapped); err != nil {
+		panic(fmt.Sprintf("can't execute timer template: %v", err))
+	}
+
+	return out.String(), nil
+}
+
+// timerUnitName returns the .timer unit name that corresponds to the
+// given .service unit name.
+func timerUnitName(serviceName string) string {
+	return strings.TrimSuffix(serviceName, ".service") + ".timer"
+}
+
+// hasTimerUnit returns true if a .timer unit file was generated alongside
+// the given .service unit.
+func hasTimerUnit(serviceName string) bool {
+	_, err := osStat(filepath.Join(dirs.SnapServicesDir, timerUnitName(serviceName)))
+	return err == nil
+}
+
+// GenDeviceDropIn generates the drop-in that, placed next to desc's
+// .service unit, makes systemd bring it up via the WantedBy= of each of
+// desc's bound devices. Callers should only call this when
+// desc.HasBoundDevices() is true.
+func (s *systemd) GenDeviceDropIn(desc *ServiceDescription) string {
+	var out bytes.Buffer
+	out.WriteString("[Install]\n")
+	for _, dev := range desc.BoundDevices {
+		fmt.Fprintf(&out, "WantedBy=%s\n", dev.DeviceUnitName())
+	}
+
+	return out.String()
+}
+
+// DeviceDropInPath returns where GenDeviceDropIn's output for desc should
+// be written, next to its .service unit.
+func DeviceDropInPath(desc *ServiceDescription) string {
+	serviceFileName := generateServiceFileName(desc)
+	return filepath.Join(dirs.SnapServicesDir, serviceFileName+".d", "bound-devices.conf")
+}
+
+// WriteDeviceDropIn writes the device-binding drop-in for desc next to its
+// .service unit, and returns the path it was written to.
+func (s *systemd) WriteDeviceDropIn(desc *ServiceDescription) (string, error) {
+	path := DeviceDropInPath(desc)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(path, []byte(s.GenDeviceDropIn(desc)), 0644); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+var mountUnitTemplate = `[Unit]
+Description=Squashfs mount unit for {{.SnapName}}
+
+[Mount]
+What={{.What}}
+Where={{.Where}}
+
+[Install]
+WantedBy={{.ServicesTarget}}
+`
+
+// MountUnitPath returns the path of the .mount (or other ext) unit that
+// would be generated for the given snap directory.
+func MountUnitPath(baseDir, ext string) string {
+	escaped := SystemdEscape(baseDir)
+	return filepath.Join(dirs.SnapServicesDir, fmt.Sprintf("%s.%s", escaped, ext))
+}
+
+// SystemdEscape escapes path the way systemd-escape --path does, so it can
+// be used as (part of) a unit name: "/" becomes "-", a leading "." is
+// escaped (unit names may not start with a dot), and anything else that
+// isn't alphanumeric, "_", "." or ":" is hex-escaped as "\xNN".
+func SystemdEscape(path string) string {
+	path = strings.Trim(path, "/")
+
+	var buf bytes.Buffer
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '/':
+			buf.WriteByte('-')
+		case i == 0 && c == '.':
+			fmt.Fprintf(&buf, `\x%02x`, c)
+		case isUnitNameSafe(c):
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, `\x%02x`, c)
+		}
+	}
+
+	return buf.String()
+}
+
+func isUnitNameSafe(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	case c == '_' || c == '.' || c == ':':
+		return true
+	default:
+		return false
+	}
+}
+
+// WriteMountUnitFile writes a systemd .mount unit file for the given
+// snap, and returns its (base) file name.
+func (s *systemd) WriteMountUnitFile(snapName, what, where string) (string, error) {
+	mountUnitName := filepath.Base(MountUnitPath(where, "mount"))
+
+	var out bytes.Buffer
+	t := template.Must(template.New(mountUnitName).Parse(mountUnitTemplate))
+	data := struct {
+		SnapName       string
+		What           string
+		Where          string
+		ServicesTarget string
+	}{snapName, what, where, servicesTarget}
+	if err := t.Execute(&out, data); err != nil {
+		return "", err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dirs.SnapServicesDir, mountUnitName), out.Bytes(), 0644); err != nil {
+		return "", err
+	}
+
+	return mountUnitName, nil
+}
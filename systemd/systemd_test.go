@@ -21,12 +21,17 @@ package systemd
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log/syslog"
 	"os"
 	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 
+	"golang.org/x/net/context"
+
 	. "gopkg.in/check.v1"
 	"gopkg.in/yaml.v2"
 
@@ -52,10 +57,12 @@ type SystemdTestSuite struct {
 	errors []error
 	outs   [][]byte
 
-	j     int
-	jsvcs [][]string
-	jouts [][]byte
-	jerrs []error
+	jUnits [][]string
+	jErr   error
+	jFake  *fakeLogReader
+
+	analyzeArgses [][]string
+	analyzeErr    error
 
 	rep *testreporter
 }
@@ -76,18 +83,27 @@ func (s *SystemdTestSuite) SetUpTest(c *C) {
 	s.errors = nil
 	s.outs = nil
 
-	JournalctlCmd = s.myJctl
-	s.j = 0
-	s.jsvcs = nil
-	s.jouts = nil
-	s.jerrs = nil
+	newJournalReader = s.myNewJournalReader
+	s.jUnits = nil
+	s.jErr = nil
+	s.jFake = nil
+
+	SystemdAnalyzeCmd = s.myAnalyze
+	s.analyzeArgses = nil
+	s.analyzeErr = nil
 
 	s.rep = new(testreporter)
 }
 
 func (s *SystemdTestSuite) TearDownTest(c *C) {
 	SystemctlCmd = run
-	JournalctlCmd = jctl
+	newJournalReader = newSdJournalReader
+	SystemdAnalyzeCmd = systemdAnalyze
+}
+
+func (s *SystemdTestSuite) myAnalyze(args ...string) ([]byte, error) {
+	s.analyzeArgses = append(s.analyzeArgses, args)
+	return nil, s.analyzeErr
 }
 
 func (s *SystemdTestSuite) myRun(args ...string) (out []byte, err error) {
@@ -102,24 +118,88 @@ func (s *SystemdTestSuite) myRun(args ...string) (out []byte, err error) {
 	return out, err
 }
 
-func (s *SystemdTestSuite) myJctl(svcs []string) (out []byte, err error) {
-	s.jsvcs = append(s.jsvcs, svcs)
-
-	if s.j < len(s.jouts) {
-		out = s.jouts[s.j]
+func (s *SystemdTestSuite) myNewJournalReader(units []string) (LogReader, error) {
+	s.jUnits = append(s.jUnits, units)
+	if s.jErr != nil {
+		return nil, s.jErr
 	}
-	if s.j < len(s.jerrs) {
-		err = s.jerrs[s.j]
+	if s.jFake == nil {
+		s.jFake = &fakeLogReader{}
 	}
-	s.j++
-
-	return out, err
+	return s.jFake, nil
 }
 
 func (s *SystemdTestSuite) errorRun(args ...string) (out []byte, err error) {
 	return nil, &Error{cmd: args, exitCode: 1, msg: []byte("error on error")}
 }
 
+// fakeLogReader is a synthetic LogReader used in tests, so they don't need
+// to link against libsystemd.
+type fakeLogReader struct {
+	entries []Log
+	pos     int
+	minPrio syslog.Priority
+	prioSet bool
+	closed  bool
+}
+
+func (f *fakeLogReader) SinceCursor(cursor string) error {
+	for i, e := range f.entries {
+		if e["__CURSOR"] == cursor {
+			f.pos = i + 1
+			return nil
+		}
+	}
+	return fmt.Errorf("cursor %q not found", cursor)
+}
+
+func (f *fakeLogReader) Tail(n int) error {
+	if n > len(f.entries) {
+		n = len(f.entries)
+	}
+	f.pos = len(f.entries) - n
+	return nil
+}
+
+func (f *fakeLogReader) MinPriority(prio syslog.Priority) error {
+	f.minPrio = prio
+	f.prioSet = true
+	return nil
+}
+
+func (f *fakeLogReader) Next() (Log, error) {
+	for f.pos < len(f.entries) {
+		e := f.entries[f.pos]
+		f.pos++
+		if f.prioSet {
+			prio, _ := strconv.Atoi(fmt.Sprint(e["PRIORITY"]))
+			if syslog.Priority(prio) > f.minPrio {
+				continue
+			}
+		}
+		return e, nil
+	}
+	return nil, io.EOF
+}
+
+func (f *fakeLogReader) Follow(ctx context.Context) (<-chan Log, error) {
+	ch := make(chan Log, len(f.entries))
+	for {
+		e, err := f.Next()
+		if err == io.EOF {
+			break
+		}
+		ch <- e
+	}
+	close(ch)
+	return ch, nil
+}
+
+func (f *fakeLogReader) Close() error {
+	f.closed = true
+	return nil
+}
+
 func (s *SystemdTestSuite) TestDaemonReload(c *C) {
 	err := New("", s.rep).DaemonReload()
 	c.Assert(err, IsNil)
@@ -307,36 +387,84 @@ func (s *SystemdTestSuite) TestIsTimeout(c *C) {
 	c.Check(IsTimeout(&Timeout{}), Equals, true)
 }
 
-func (s *SystemdTestSuite) TestLogErrJctl(c *C) {
-	s.jerrs = []error{&Timeout{}}
-
-	logs, err := New("", s.rep).Logs([]string{"foo"})
-	c.Check(err, NotNil)
-	c.Check(logs, IsNil)
-	c.Check(s.jsvcs, DeepEquals, [][]string{{"foo"}})
-	c.Check(s.j, Equals, 1)
-}
-
-func (s *SystemdTestSuite) TestLogErrJSON(c *C) {
-	s.jouts = [][]byte{[]byte("this is not valid json.")}
+func (s *SystemdTestSuite) TestLogsErrOpen(c *C) {
+	s.jErr = &Timeout{}
 
 	logs, err := New("", s.rep).Logs([]string{"foo"})
 	c.Check(err, NotNil)
 	c.Check(logs, IsNil)
-	c.Check(s.jsvcs, DeepEquals, [][]string{{"foo"}})
-	c.Check(s.j, Equals, 1)
+	c.Check(s.jUnits, DeepEquals, [][]string{{"foo"}})
 }
 
 func (s *SystemdTestSuite) TestLogs(c *C) {
-	s.jouts = [][]byte{[]byte(`{"a": 1}
-{"a": 2}
-`)}
+	s.jFake = &fakeLogReader{entries: []Log{{"a": 1.}, {"a": 2.}}}
 
 	logs, err := New("", s.rep).Logs([]string{"foo"})
 	c.Check(err, IsNil)
 	c.Check(logs, DeepEquals, []Log{{"a": 1.}, {"a": 2.}})
-	c.Check(s.jsvcs, DeepEquals, [][]string{{"foo"}})
-	c.Check(s.j, Equals, 1)
+	c.Check(s.jUnits, DeepEquals, [][]string{{"foo"}})
+	c.Check(s.jFake.closed, Equals, true)
+}
+
+func (s *SystemdTestSuite) TestLogsMinPriority(c *C) {
+	fake := &fakeLogReader{
+		entries: []Log{
+			{"PRIORITY": "3", "MESSAGE": "err"},
+			{"PRIORITY": "6", "MESSAGE": "info"},
+		},
+	}
+
+	c.Assert(fake.MinPriority(syslog.Priority(4)), IsNil)
+	log, err := fake.Next()
+	c.Assert(err, IsNil)
+	c.Check(log["MESSAGE"], Equals, "err")
+
+	_, err = fake.Next()
+	c.Check(err, Equals, io.EOF)
+}
+
+func (s *SystemdTestSuite) TestLogsSinceCursor(c *C) {
+	fake := &fakeLogReader{
+		entries: []Log{
+			{"__CURSOR": "c1", "MESSAGE": "one"},
+			{"__CURSOR": "c2", "MESSAGE": "two"},
+		},
+	}
+
+	c.Assert(fake.SinceCursor("c1"), IsNil)
+	log, err := fake.Next()
+	c.Assert(err, IsNil)
+	c.Check(log["MESSAGE"], Equals, "two")
+}
+
+func (s *SystemdTestSuite) TestLogsTail(c *C) {
+	fake := &fakeLogReader{
+		entries: []Log{
+			{"MESSAGE": "one"},
+			{"MESSAGE": "two"},
+			{"MESSAGE": "three"},
+		},
+	}
+
+	c.Assert(fake.Tail(1), IsNil)
+	log, err := fake.Next()
+	c.Assert(err, IsNil)
+	c.Check(log["MESSAGE"], Equals, "three")
+}
+
+func (s *SystemdTestSuite) TestLogsFollow(c *C) {
+	fake := &fakeLogReader{
+		entries: []Log{{"MESSAGE": "one"}, {"MESSAGE": "two"}},
+	}
+
+	ch, err := fake.Follow(context.Background())
+	c.Assert(err, IsNil)
+
+	var got []Log
+	for log := range ch {
+		got = append(got, log)
+	}
+	c.Check(got, DeepEquals, fake.entries)
 }
 
 func (s *SystemdTestSuite) TestLogString(c *C) {
@@ -356,6 +484,12 @@ func (s *SystemdTestSuite) TestLogString(c *C) {
 		"MESSAGE":              "hi",
 		"SYSLOG_IDENTIFIER":    "me",
 	}.String(), Equals, "1970-01-01T00:00:00.000042Z me hi")
+	c.Check(Log{
+		"__REALTIME_TIMESTAMP": "42",
+		"MESSAGE":              "hi",
+		"SYSLOG_IDENTIFIER":    "me",
+		"PRIORITY":             "3",
+	}.String(), Equals, "1970-01-01T00:00:00.000042Z <3> me hi")
 
 }
 
@@ -397,3 +531,239 @@ func (s *SystemdTestSuite) TestRestartCondString(c *C) {
 		c.Check(cond.String(), Equals, name, Commentf(name))
 	}
 }
+
+func (s *SystemdTestSuite) TestGenSocketFileStream(c *C) {
+	desc := &ServiceDescription{
+		SnapName:     "app",
+		AppName:      "service",
+		Version:      "1.0",
+		ListenStream: "/var/run/app.socket",
+		SocketMode:   "0666",
+	}
+
+	c.Check(New("", nil).GenSocketFile(desc), Equals, `[Socket]
+ListenStream=/var/run/app.socket
+SocketMode=0666
+
+[Install]
+WantedBy=sockets.target
+`)
+}
+
+func (s *SystemdTestSuite) TestGenSocketFileDatagram(c *C) {
+	desc := &ServiceDescription{
+		SnapName:       "app",
+		AppName:        "service",
+		Version:        "1.0",
+		ListenDatagram: "/var/run/app.dgram",
+	}
+
+	c.Check(New("", nil).GenSocketFile(desc), Equals, `[Socket]
+ListenDatagram=/var/run/app.dgram
+
+[Install]
+WantedBy=sockets.target
+`)
+}
+
+func (s *SystemdTestSuite) TestGenSocketFileAccept(c *C) {
+	desc := &ServiceDescription{
+		SnapName:     "app",
+		AppName:      "service",
+		Version:      "1.0",
+		ListenStream: "/var/run/app.socket",
+		Accept:       true,
+		SocketUser:   "snap_daemon",
+		SocketGroup:  "snap_daemon",
+	}
+
+	c.Check(New("", nil).GenSocketFile(desc), Equals, `[Socket]
+ListenStream=/var/run/app.socket
+Accept=yes
+SocketUser=snap_daemon
+SocketGroup=snap_daemon
+
+[Install]
+WantedBy=sockets.target
+`)
+}
+
+func (s *SystemdTestSuite) TestGenServiceFileWithSocket(c *C) {
+	desc := &ServiceDescription{
+		SnapName:     "app",
+		AppName:      "service",
+		Version:      "1.0",
+		SnapPath:     "/apps/app/1.0",
+		Start:        "bin/start",
+		ListenStream: "/var/run/app.socket",
+	}
+
+	generated := New("", nil).GenServiceFile(desc)
+	c.Check(generated, Matches, `(?ms).*^Also=app_service_1.0.socket$.*`)
+}
+
+func (s *SystemdTestSuite) TestGenServiceFileWithAcceptSocketIsATemplate(c *C) {
+	desc := &ServiceDescription{
+		SnapName:     "app",
+		AppName:      "service",
+		Version:      "1.0",
+		SnapPath:     "/apps/app/1.0",
+		Start:        "bin/start",
+		ListenStream: "/var/run/app.socket",
+		Accept:       true,
+	}
+
+	// Accept=yes sockets can't use Service=, so the unit systemd
+	// activates per-connection must be an instantiated template...
+	c.Check(generateServiceFileName(desc), Equals, "app_service_1.0@.service")
+
+	// ...but the socket unit itself is never a template.
+	generated := New("", nil).GenServiceFile(desc)
+	c.Check(generated, Matches, `(?ms).*^Also=app_service_1.0.socket$.*`)
+}
+
+func (s *SystemdTestSuite) TestEnableStartRouteToSocket(c *C) {
+	socketPath := filepath.Join(dirs.SnapServicesDir, "foo.socket")
+	err := ioutil.WriteFile(socketPath, nil, 0644)
+	c.Assert(err, IsNil)
+
+	sysd := New("", s.rep)
+
+	c.Assert(sysd.Enable("foo.service"), IsNil)
+	c.Check(s.argses[len(s.argses)-1], DeepEquals, []string{"enable", "foo.socket"})
+
+	c.Assert(sysd.Start("foo.service"), IsNil)
+	c.Check(s.argses[len(s.argses)-1], DeepEquals, []string{"start", "foo.socket"})
+}
+
+func (s *SystemdTestSuite) TestEnableWithoutSocket(c *C) {
+	err := New("", s.rep).Enable("bar.service")
+	c.Assert(err, IsNil)
+	c.Check(s.argses, DeepEquals, [][]string{{"enable", "bar.service"}})
+}
+
+func (s *SystemdTestSuite) TestGenTimerFile(c *C) {
+	desc := &ServiceDescription{
+		SnapName:    "app",
+		AppName:     "service",
+		Version:     "1.0",
+		Description: "descr",
+		Timer: &TimerSchedule{
+			OnCalendar:         "daily",
+			Persistent:         true,
+			RandomizedDelaySec: "300",
+		},
+	}
+
+	generated, err := New("", nil).GenTimerFile(desc)
+	c.Assert(err, IsNil)
+	c.Check(generated, Equals, `[Unit]
+Description=descr
+X-Snappy=yes
+
+[Timer]
+OnCalendar=daily
+Persistent=yes
+RandomizedDelaySec=300
+Unit=app_service_1.0.service
+
+[Install]
+WantedBy=timers.target
+`)
+	c.Check(s.analyzeArgses, DeepEquals, [][]string{{"calendar", "daily"}})
+}
+
+func (s *SystemdTestSuite) TestGenTimerFileRejectsBadCalendar(c *C) {
+	s.analyzeErr = &Error{cmd: []string{"systemd-analyze"}, exitCode: 1, msg: []byte("bad schedule")}
+
+	desc := &ServiceDescription{
+		SnapName: "app",
+		Timer:    &TimerSchedule{OnCalendar: "not a calendar spec"},
+	}
+
+	_, err := New("", nil).GenTimerFile(desc)
+	c.Assert(err, NotNil)
+}
+
+func (s *SystemdTestSuite) TestEnableRoutesToTimer(c *C) {
+	timerPath := filepath.Join(dirs.SnapServicesDir, "foo.timer")
+	err := ioutil.WriteFile(timerPath, nil, 0644)
+	c.Assert(err, IsNil)
+
+	c.Assert(New("", s.rep).Enable("foo.service"), IsNil)
+	c.Check(s.argses, DeepEquals, [][]string{{"enable", "foo.timer"}})
+
+	c.Assert(New("", s.rep).Start("foo.service"), IsNil)
+	c.Check(s.argses[len(s.argses)-1], DeepEquals, []string{"start", "foo.service"})
+}
+
+func (s *SystemdTestSuite) TestSystemdEscape(c *C) {
+	c.Check(SystemdEscape("/apps/hello/1.1"), Equals, "apps-hello-1.1")
+	c.Check(SystemdEscape("/dev/bus/usb/001/002"), Equals, "dev-bus-usb-001-002")
+	c.Check(SystemdEscape("/.hidden/thing"), Equals, `\x2ehidden-thing`)
+	c.Check(SystemdEscape("/dev/ttyUSB0"), Equals, "dev-ttyUSB0")
+}
+
+func (s *SystemdTestSuite) TestGenServiceFileWithBoundDevice(c *C) {
+	desc := &ServiceDescription{
+		SnapName: "app",
+		AppName:  "service",
+		Version:  "1.0",
+		SnapPath: "/apps/app/1.0",
+		Start:    "bin/start",
+		BoundDevices: []DeviceMatch{
+			{KernelName: "ttyUSB0"},
+		},
+	}
+
+	generated := New("", nil).GenServiceFile(desc)
+	c.Check(generated, Matches, `(?ms).*^BindsTo=dev-ttyUSB0.device$.*`)
+	c.Check(generated, Matches, `(?ms).*^After=dev-ttyUSB0.device$.*`)
+}
+
+func (s *SystemdTestSuite) TestDeviceUnitNameUsesTagOverKernelName(c *C) {
+	d := &DeviceMatch{Subsystem: "tty", KernelName: "ttyUSB0", Tag: "my-modem"}
+	c.Check(d.DeviceUnitName(), Equals, "dev-my\\x2dmodem.device")
+}
+
+func (s *SystemdTestSuite) TestGenDeviceUdevRule(c *C) {
+	c.Check(GenDeviceUdevRule(&DeviceMatch{Subsystem: "tty", KernelName: "ttyUSB0"}),
+		Equals, `SUBSYSTEM=="tty", KERNEL=="ttyUSB0", TAG+="systemd"`+"\n")
+
+	c.Check(GenDeviceUdevRule(&DeviceMatch{Subsystem: "tty", KernelName: "ttyUSB*", Tag: "my-modem"}),
+		Equals, `SUBSYSTEM=="tty", KERNEL=="ttyUSB*", TAG+="systemd", ENV{SYSTEMD_ALIAS}="/dev/my-modem"`+"\n")
+}
+
+func (s *SystemdTestSuite) TestGenDeviceDropIn(c *C) {
+	desc := &ServiceDescription{
+		SnapName: "app",
+		AppName:  "service",
+		Version:  "1.0",
+		BoundDevices: []DeviceMatch{
+			{KernelName: "ttyUSB0"},
+			{KernelName: "bus/usb/001/002"},
+		},
+	}
+
+	c.Check(New("", nil).GenDeviceDropIn(desc), Equals, `[Install]
+WantedBy=dev-ttyUSB0.device
+WantedBy=dev-bus-usb-001-002.device
+`)
+}
+
+func (s *SystemdTestSuite) TestWriteDeviceDropIn(c *C) {
+	desc := &ServiceDescription{
+		SnapName:     "app",
+		AppName:      "service",
+		Version:      "1.0",
+		BoundDevices: []DeviceMatch{{KernelName: "ttyUSB0"}},
+	}
+
+	path, err := New("", nil).WriteDeviceDropIn(desc)
+	c.Assert(err, IsNil)
+	c.Check(path, Equals, filepath.Join(dirs.SnapServicesDir, "app_service_1.0.service.d", "bound-devices.conf"))
+
+	content, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Check(string(content), Equals, "[Install]\nWantedBy=dev-ttyUSB0.device\n")
+}